@@ -0,0 +1,26 @@
+package allocator
+
+import (
+	"fmt"
+	"net"
+)
+
+// Addr is an address of client, server or peer as used by the allocator.
+//
+// The field layout mirrors stun.XORMappedAddress and turn.PeerAddress so
+// that values can be freely cast between the two without copying.
+type Addr struct {
+	IP   net.IP
+	Port int
+}
+
+func (a Addr) String() string {
+	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+}
+
+func (a Addr) Network() string { return "udp" }
+
+// Equal returns true if b has the same IP and port as a.
+func (a Addr) Equal(b Addr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
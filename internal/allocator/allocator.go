@@ -0,0 +1,316 @@
+// Package allocator implements TURN allocation, permission and channel
+// bookkeeping as described in RFC 5766.
+package allocator
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/gortc/turn"
+)
+
+// PeerHandler processes data received from a remote peer on behalf of
+// an allocation.
+type PeerHandler interface {
+	HandlePeerData(d []byte, t FiveTuple, a Addr)
+}
+
+// Errors returned by Allocator.
+var (
+	ErrAllocationNotFound     = errors.New("allocation not found")
+	ErrAllocationMismatch     = errors.New("allocation mismatch")
+	ErrChannelBindingMismatch = errors.New("channel binding mismatch")
+	ErrInvalidChannelNumber   = errors.New("channel number out of range")
+)
+
+// channelMinNumber and channelMaxNumber bound the channel number space
+// reserved for ChannelBind requests by RFC 5766 Section 11.
+const (
+	channelMinNumber = 0x4000
+	channelMaxNumber = 0x7FFF
+)
+
+// defaultAllocationLifetime is the lifetime assigned to a fresh
+// allocation until the first Refresh, per RFC 5766 Section 2.2.
+const defaultAllocationLifetime = 10 * time.Minute
+
+// DefaultMaxLifetime bounds how long an allocation may be kept alive by
+// Refresh requests when Allocator is constructed without an explicit
+// maximum, per RFC 5766 Section 6.2.
+const DefaultMaxLifetime = time.Hour
+
+type allocation struct {
+	tuple   FiveTuple
+	relayed Addr
+	conn    net.PacketConn
+
+	deadline time.Time
+
+	permissions map[string]time.Time
+	channels    map[uint16]*channelBinding
+	byPeer      map[string]*channelBinding
+}
+
+type channelBinding struct {
+	number   uint16
+	peer     Addr
+	deadline time.Time
+}
+
+// Allocator manages TURN allocations, permissions and channel bindings,
+// keyed by the client's five-tuple so the same client address can hold
+// independent allocations on distinct server transport addresses.
+type Allocator struct {
+	mux         sync.Mutex
+	log         *zap.Logger
+	ports       *NetAllocator
+	maxLifetime time.Duration
+	allocs      map[string]*allocation
+}
+
+// NewAllocator returns a new Allocator that allocates relayed transport
+// addresses via ports. maxLifetime bounds the lifetime a client can
+// obtain via Allocate/Refresh; a zero value defaults to
+// DefaultMaxLifetime.
+func NewAllocator(log *zap.Logger, ports *NetAllocator, maxLifetime time.Duration) *Allocator {
+	if maxLifetime <= 0 {
+		maxLifetime = DefaultMaxLifetime
+	}
+	return &Allocator{
+		log:         log,
+		ports:       ports,
+		maxLifetime: maxLifetime,
+		allocs:      make(map[string]*allocation),
+	}
+}
+
+// clampLifetime bounds requested against a.maxLifetime, falling back to
+// defaultAllocationLifetime when requested is zero.
+func (a *Allocator) clampLifetime(requested time.Duration) time.Duration {
+	if requested <= 0 {
+		requested = defaultAllocationLifetime
+	}
+	if requested > a.maxLifetime {
+		requested = a.maxLifetime
+	}
+	return requested
+}
+
+// New creates a new allocation for t and returns its relayed transport
+// address and the reservation token produced for a paired EVEN-PORT
+// allocation, if any. Peer data received on the relayed socket is
+// forwarded to h. Creating an allocation for a five-tuple that already
+// has one is rejected with ErrAllocationMismatch, per RFC 5766 Section
+// 6.2.
+func (a *Allocator) New(t FiveTuple, opts AllocOptions, requestedLifetime time.Duration, h PeerHandler) (Addr, string, error) {
+	a.mux.Lock()
+	if _, ok := a.allocs[t.String()]; ok {
+		a.mux.Unlock()
+		return Addr{}, "", ErrAllocationMismatch
+	}
+	a.mux.Unlock()
+
+	conn, relayed, token, err := a.ports.Alloc(turn.ProtoUDP, opts)
+	if err != nil {
+		return Addr{}, "", errors.Wrap(err, "failed to allocate relayed address")
+	}
+	alloc := &allocation{
+		tuple:       t,
+		relayed:     relayed,
+		conn:        conn,
+		deadline:    time.Now().Add(a.clampLifetime(requestedLifetime)),
+		permissions: make(map[string]time.Time),
+		channels:    make(map[uint16]*channelBinding),
+		byPeer:      make(map[string]*channelBinding),
+	}
+	a.mux.Lock()
+	if _, ok := a.allocs[t.String()]; ok {
+		a.mux.Unlock()
+		conn.Close() // nolint:errcheck
+		return Addr{}, "", ErrAllocationMismatch
+	}
+	a.allocs[t.String()] = alloc
+	a.mux.Unlock()
+	go a.readLoop(alloc, h)
+	return relayed, token, nil
+}
+
+func (a *Allocator) readLoop(alloc *allocation, h PeerHandler) {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := alloc.conn.ReadFrom(buf)
+		if err != nil {
+			a.log.Debug("relay socket closed", zap.Stringer("relayed", alloc.relayed))
+			return
+		}
+		peer, err := addrFromNet(addr)
+		if err != nil {
+			a.log.Warn("failed to parse peer address", zap.Error(err))
+			continue
+		}
+		h.HandlePeerData(append([]byte(nil), buf[:n]...), alloc.tuple, peer)
+	}
+}
+
+func (a *Allocator) find(t FiveTuple) (*allocation, error) {
+	alloc, ok := a.allocs[t.String()]
+	if !ok {
+		return nil, ErrAllocationNotFound
+	}
+	return alloc, nil
+}
+
+// Remove deallocates the allocation belonging to t, closing its relayed
+// socket.
+func (a *Allocator) Remove(t FiveTuple) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	alloc, ok := a.allocs[t.String()]
+	if !ok {
+		return
+	}
+	delete(a.allocs, t.String())
+	alloc.conn.Close() // nolint:errcheck
+}
+
+// Refresh extends the lifetime of the allocation belonging to t,
+// clamping requestedLifetime to a.maxLifetime, per RFC 5766 Section
+// 7.2. A requestedLifetime of zero removes the allocation instead.
+func (a *Allocator) Refresh(t FiveTuple, now time.Time, requestedLifetime time.Duration) error {
+	if requestedLifetime == 0 {
+		a.Remove(t)
+		return nil
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	alloc, err := a.find(t)
+	if err != nil {
+		return err
+	}
+	alloc.deadline = now.Add(a.clampLifetime(requestedLifetime))
+	return nil
+}
+
+// CreatePermission installs or refreshes a permission for peer on the
+// allocation belonging to t.
+func (a *Allocator) CreatePermission(t FiveTuple, peer Addr, deadline time.Time) error {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	alloc, err := a.find(t)
+	if err != nil {
+		return err
+	}
+	alloc.permissions[peer.String()] = deadline
+	return nil
+}
+
+func (a *allocation) hasPermission(peer Addr) bool {
+	_, ok := a.permissions[peer.String()]
+	return ok
+}
+
+// Send relays data to peer on behalf of the allocation belonging to t,
+// provided a permission for peer exists.
+func (a *Allocator) Send(t FiveTuple, peer Addr, data turn.Data) (int, error) {
+	a.mux.Lock()
+	alloc, err := a.find(t)
+	a.mux.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if !alloc.hasPermission(peer) {
+		return 0, errors.Errorf("no permission installed for %s", peer)
+	}
+	destination := &net.UDPAddr{IP: peer.IP, Port: peer.Port}
+	n, err := alloc.conn.WriteTo(data, destination)
+	return n, errors.Wrap(err, "failed to write to peer")
+}
+
+// ChannelBind binds number to peer on the allocation belonging to t,
+// per RFC 5766 Section 11.1. Rebinding the same (t, number, peer) tuple
+// refreshes the channel lifetime. Binding a number already bound to a
+// different peer, or binding a peer that already has a different
+// number, is rejected as a collision per RFC 5766 Section 11.2.
+func (a *Allocator) ChannelBind(t FiveTuple, peer Addr, number uint16, expiry time.Time) error {
+	if number < channelMinNumber || number > channelMaxNumber {
+		return ErrInvalidChannelNumber
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	alloc, err := a.find(t)
+	if err != nil {
+		return err
+	}
+	if existing, ok := alloc.channels[number]; ok && !existing.peer.Equal(peer) {
+		return ErrChannelBindingMismatch
+	}
+	if existing, ok := alloc.byPeer[peer.String()]; ok && existing.number != number {
+		return ErrChannelBindingMismatch
+	}
+	ch := &channelBinding{number: number, peer: peer, deadline: expiry}
+	alloc.channels[number] = ch
+	alloc.byPeer[peer.String()] = ch
+	alloc.permissions[peer.String()] = expiry
+	return nil
+}
+
+// Channel returns the channel number bound to peer on the allocation
+// belonging to t, if any.
+func (a *Allocator) Channel(t FiveTuple, peer Addr) (uint16, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	alloc, err := a.find(t)
+	if err != nil {
+		return 0, false
+	}
+	ch, ok := alloc.byPeer[peer.String()]
+	if !ok {
+		return 0, false
+	}
+	return ch.number, true
+}
+
+// ChannelPeer returns the peer address bound to number on the
+// allocation belonging to t, if any.
+func (a *Allocator) ChannelPeer(t FiveTuple, number uint16) (Addr, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	alloc, err := a.find(t)
+	if err != nil {
+		return Addr{}, false
+	}
+	ch, ok := alloc.channels[number]
+	if !ok {
+		return Addr{}, false
+	}
+	return ch.peer, true
+}
+
+// Collect expires permissions, channel bindings, allocations and
+// reserved ports whose deadline is before t.
+func (a *Allocator) Collect(t time.Time) {
+	a.ports.Collect(t)
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for key, alloc := range a.allocs {
+		for peer, deadline := range alloc.permissions {
+			if t.After(deadline) {
+				delete(alloc.permissions, peer)
+			}
+		}
+		for number, ch := range alloc.channels {
+			if t.After(ch.deadline) {
+				delete(alloc.channels, number)
+				delete(alloc.byPeer, ch.peer.String())
+			}
+		}
+		if t.After(alloc.deadline) {
+			alloc.conn.Close() // nolint:errcheck
+			delete(a.allocs, key)
+		}
+	}
+}
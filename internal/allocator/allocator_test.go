@@ -0,0 +1,210 @@
+package allocator
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type noopHandler struct{}
+
+func (noopHandler) HandlePeerData([]byte, FiveTuple, Addr) {}
+
+func mustNetAllocator(t *testing.T, server net.Addr) *NetAllocator {
+	t.Helper()
+	na, err := NewNetAllocator(zap.NewNop(), server, SystemPortAllocator{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return na
+}
+
+func TestAllocator_New_distinctServerKeepsClientIndependent(t *testing.T) {
+	client := Addr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	serverA := Addr{IP: net.ParseIP("127.0.0.1"), Port: 3478}
+	serverB := Addr{IP: net.ParseIP("127.0.0.1"), Port: 3479}
+
+	a := NewAllocator(zap.NewNop(), mustNetAllocator(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478}), 0)
+
+	tupleA := FiveTuple{Client: client, Server: serverA, Proto: TransportUDP}
+	tupleB := FiveTuple{Client: client, Server: serverB, Proto: TransportUDP}
+
+	relayedA, _, err := a.New(tupleA, AllocOptions{}, 0, noopHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayedB, _, err := a.New(tupleB, AllocOptions{}, 0, noopHandler{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relayedA.Equal(relayedB) {
+		t.Fatal("allocations for distinct five-tuples should not share a relayed socket")
+	}
+	if err := a.CreatePermission(tupleA, Addr{IP: net.ParseIP("127.0.0.1"), Port: 9}, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.find(tupleB); err != nil {
+		t.Fatal("allocation for tupleB should still exist untouched by tupleA's permission")
+	}
+	a.Remove(tupleA)
+	if _, err := a.find(tupleA); err != ErrAllocationNotFound {
+		t.Fatalf("got %v, want ErrAllocationNotFound", err)
+	}
+	if _, err := a.find(tupleB); err != nil {
+		t.Fatal("removing tupleA must not remove tupleB")
+	}
+}
+
+func TestAllocator_New_duplicateFiveTupleIsMismatch(t *testing.T) {
+	client := Addr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	server := Addr{IP: net.ParseIP("127.0.0.1"), Port: 3478}
+	a := NewAllocator(zap.NewNop(), mustNetAllocator(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478}), 0)
+
+	tuple := FiveTuple{Client: client, Server: server, Proto: TransportUDP}
+	if _, _, err := a.New(tuple, AllocOptions{}, 0, noopHandler{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := a.New(tuple, AllocOptions{}, 0, noopHandler{}); err != ErrAllocationMismatch {
+		t.Fatalf("got %v, want ErrAllocationMismatch", err)
+	}
+}
+
+func TestAllocator_clampLifetime(t *testing.T) {
+	a := NewAllocator(zap.NewNop(), mustNetAllocator(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478}), 30*time.Second)
+	if got := a.clampLifetime(time.Hour); got != 30*time.Second {
+		t.Fatalf("got %s, want clamped to maxLifetime 30s", got)
+	}
+	if got := a.clampLifetime(0); got != 30*time.Second {
+		t.Fatalf("got %s, want default clamped to maxLifetime 30s", got)
+	}
+}
+
+func mustTuple(t *testing.T, a *Allocator) FiveTuple {
+	t.Helper()
+	tuple := FiveTuple{
+		Client: Addr{IP: net.ParseIP("127.0.0.1"), Port: 1},
+		Server: Addr{IP: net.ParseIP("127.0.0.1"), Port: 3478},
+		Proto:  TransportUDP,
+	}
+	if _, _, err := a.New(tuple, AllocOptions{}, 0, noopHandler{}); err != nil {
+		t.Fatal(err)
+	}
+	return tuple
+}
+
+func TestAllocator_ChannelBind_rebindSamePeerIsIdempotent(t *testing.T) {
+	a := NewAllocator(zap.NewNop(), mustNetAllocator(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478}), 0)
+	tuple := mustTuple(t, a)
+	peer := Addr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+
+	if err := a.ChannelBind(tuple, peer, channelMinNumber, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ChannelBind(tuple, peer, channelMinNumber, time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatalf("rebinding the same (peer, number) pair should refresh, not error: %v", err)
+	}
+	number, ok := a.Channel(tuple, peer)
+	if !ok || number != channelMinNumber {
+		t.Fatalf("got (%d, %v), want (%d, true)", number, ok, channelMinNumber)
+	}
+	got, ok := a.ChannelPeer(tuple, channelMinNumber)
+	if !ok || !got.Equal(peer) {
+		t.Fatalf("got (%s, %v), want (%s, true)", got, ok, peer)
+	}
+}
+
+func TestAllocator_ChannelBind_collisionIsRejected(t *testing.T) {
+	a := NewAllocator(zap.NewNop(), mustNetAllocator(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478}), 0)
+	tuple := mustTuple(t, a)
+	peerA := Addr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	peerB := Addr{IP: net.ParseIP("127.0.0.1"), Port: 10}
+
+	if err := a.ChannelBind(tuple, peerA, channelMinNumber, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ChannelBind(tuple, peerB, channelMinNumber, time.Now().Add(time.Minute)); err != ErrChannelBindingMismatch {
+		t.Fatalf("got %v, want ErrChannelBindingMismatch binding a bound number to a new peer", err)
+	}
+	if err := a.ChannelBind(tuple, peerA, channelMinNumber+1, time.Now().Add(time.Minute)); err != ErrChannelBindingMismatch {
+		t.Fatalf("got %v, want ErrChannelBindingMismatch binding a bound peer to a new number", err)
+	}
+}
+
+func TestAllocator_ChannelBind_rejectsOutOfRangeNumber(t *testing.T) {
+	a := NewAllocator(zap.NewNop(), mustNetAllocator(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478}), 0)
+	tuple := mustTuple(t, a)
+	peer := Addr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	if err := a.ChannelBind(tuple, peer, channelMinNumber-1, time.Now().Add(time.Minute)); err != ErrInvalidChannelNumber {
+		t.Fatalf("got %v, want ErrInvalidChannelNumber", err)
+	}
+}
+
+func TestAllocator_Collect_expiresChannelBindingAndPermission(t *testing.T) {
+	a := NewAllocator(zap.NewNop(), mustNetAllocator(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478}), 0)
+	tuple := mustTuple(t, a)
+	peer := Addr{IP: net.ParseIP("127.0.0.1"), Port: 9}
+	past := time.Now().Add(-time.Minute)
+
+	if err := a.ChannelBind(tuple, peer, channelMinNumber, past); err != nil {
+		t.Fatal(err)
+	}
+	a.Collect(time.Now())
+	if _, ok := a.Channel(tuple, peer); ok {
+		t.Fatal("expired channel binding should have been collected")
+	}
+	if _, ok := a.ChannelPeer(tuple, channelMinNumber); ok {
+		t.Fatal("expired channel binding should no longer resolve by number")
+	}
+	alloc, err := a.find(tuple)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alloc.hasPermission(peer) {
+		t.Fatal("expired permission should have been collected")
+	}
+}
+
+// TestAllocator_Send_forwardsDataToChannelPeer exercises the path
+// processChannelData relies on: resolving a bound channel number back
+// to its peer address and relaying decoded ChannelData payload to
+// that peer's real socket, per RFC 5766 Section 11.4.
+func TestAllocator_Send_forwardsDataToChannelPeer(t *testing.T) {
+	peerConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConn.Close() // nolint:errcheck
+	peer, err := addrFromNet(peerConn.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAllocator(zap.NewNop(), mustNetAllocator(t, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 3478}), 0)
+	tuple := mustTuple(t, a)
+	if err := a.ChannelBind(tuple, peer, channelMinNumber, time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	resolved, ok := a.ChannelPeer(tuple, channelMinNumber)
+	if !ok {
+		t.Fatal("expected bound channel to resolve to peer")
+	}
+	want := []byte("channel data")
+	if _, err := a.Send(tuple, resolved, want); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1500)
+	if err := peerConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := peerConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != string(want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
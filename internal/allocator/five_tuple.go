@@ -0,0 +1,50 @@
+package allocator
+
+import (
+	"fmt"
+)
+
+// Transport identifies the client<->server transport a five-tuple was
+// observed on. It is distinct from turn.Protocol, which names the
+// relay protocol negotiated via REQUESTED-TRANSPORT and, per RFC 5766
+// Section 6.2, is always UDP; Transport additionally covers the
+// TCP/TLS control connections served alongside UDP.
+type Transport byte
+
+// Transport values, one per listener kind a Server can be configured
+// with.
+const (
+	TransportUDP Transport = iota
+	TransportTCP
+	TransportTLS
+)
+
+func (t Transport) String() string {
+	switch t {
+	case TransportUDP:
+		return "udp"
+	case TransportTCP:
+		return "tcp"
+	case TransportTLS:
+		return "tls"
+	default:
+		return "unknown"
+	}
+}
+
+// FiveTuple identifies an allocation by the client's address, the
+// server transport address the client used to reach it, and the
+// transport protocol between them, per RFC 5766 Section 2.
+//
+// Server is the control-plane listening address (the UDP socket or
+// TCP/TLS listener the Allocate request arrived on), not the relayed
+// transport address returned to the client.
+type FiveTuple struct {
+	Client Addr
+	Server Addr
+	Proto  Transport
+}
+
+func (t FiveTuple) String() string {
+	return fmt.Sprintf("%s->%s(%s)", t.Client, t.Server, t.Proto)
+}
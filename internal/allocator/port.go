@@ -0,0 +1,217 @@
+package allocator
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/gortc/turn"
+)
+
+// reservationLifetime bounds how long a reserved port from an
+// EVEN-PORT/R allocation waits to be claimed via RESERVATION-TOKEN
+// before it is closed, per RFC 5766 Section 6.2.
+const reservationLifetime = 30 * time.Second
+
+// maxEvenPortAttempts bounds how many sockets SystemPortAllocator will
+// open while looking for an even port number.
+const maxEvenPortAttempts = 16
+
+// PortAllocator allocates a transport-layer socket for a relayed
+// transport address.
+type PortAllocator interface {
+	Alloc(network string, ip net.IP) (net.PacketConn, error)
+	// AllocEven behaves like Alloc but only returns a socket bound to
+	// an even port number, per the EVEN-PORT attribute of RFC 5766
+	// Section 14.6.
+	AllocEven(network string, ip net.IP) (net.PacketConn, error)
+}
+
+// SystemPortAllocator allocates ports using the OS network stack,
+// letting the kernel pick a free port.
+type SystemPortAllocator struct{}
+
+// Alloc implements PortAllocator.
+func (SystemPortAllocator) Alloc(network string, ip net.IP) (net.PacketConn, error) {
+	return net.ListenPacket(network, net.JoinHostPort(ip.String(), "0"))
+}
+
+// AllocEven implements PortAllocator.
+func (p SystemPortAllocator) AllocEven(network string, ip net.IP) (net.PacketConn, error) {
+	for i := 0; i < maxEvenPortAttempts; i++ {
+		conn, err := p.Alloc(network, ip)
+		if err != nil {
+			return nil, err
+		}
+		addr, err := addrFromNet(conn.LocalAddr())
+		if err != nil {
+			conn.Close() // nolint:errcheck
+			return nil, err
+		}
+		if addr.Port%2 == 0 {
+			return conn, nil
+		}
+		conn.Close() // nolint:errcheck
+	}
+	return nil, errors.New("failed to allocate an even port")
+}
+
+// AllocOptions configures a relayed socket allocation, covering the
+// EVEN-PORT and RESERVATION-TOKEN mechanisms of RFC 5766 Section 6.2.
+type AllocOptions struct {
+	// EvenPort requests a relayed address with an even port number.
+	EvenPort bool
+	// NextPort additionally reserves the next higher (odd) port for a
+	// later allocation, per the "R" bit of EVEN-PORT.
+	NextPort bool
+	// ReservationToken reuses a port previously reserved via NextPort,
+	// instead of allocating a new one.
+	ReservationToken string
+}
+
+type reservation struct {
+	conn     net.PacketConn
+	deadline time.Time
+}
+
+// NetAllocator allocates relayed transport addresses backed by real
+// network sockets.
+type NetAllocator struct {
+	log   *zap.Logger
+	ip    net.IP
+	ports PortAllocator
+
+	mux          sync.Mutex
+	reservations map[string]reservation
+}
+
+// NewNetAllocator returns NetAllocator that allocates relayed sockets
+// on the same IP as server, using ports supplied by p.
+func NewNetAllocator(log *zap.Logger, server net.Addr, p PortAllocator) (*NetAllocator, error) {
+	host, _, err := net.SplitHostPort(server.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse server address")
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.Errorf("failed to parse server ip %s", host)
+	}
+	return &NetAllocator{
+		log:          log,
+		ip:           ip,
+		ports:        p,
+		reservations: make(map[string]reservation),
+	}, nil
+}
+
+// Alloc allocates a new relayed transport socket for proto, honoring
+// opts. proto is always turn.ProtoUDP: RFC 5766 Section 6.2 restricts
+// REQUESTED-TRANSPORT to UDP, and TCP relaying (RFC 6062) is not
+// implemented. It returns the reservation token for the paired port
+// when opts.NextPort is set, or an empty string otherwise.
+func (a *NetAllocator) Alloc(proto turn.Protocol, opts AllocOptions) (net.PacketConn, Addr, string, error) {
+	if proto != turn.ProtoUDP {
+		return nil, Addr{}, "", errors.Errorf("unsupported relay protocol %s", proto)
+	}
+	const network = "udp"
+	if opts.ReservationToken != "" {
+		conn, ok := a.takeReservation(opts.ReservationToken)
+		if !ok {
+			return nil, Addr{}, "", errors.Errorf("unknown or expired reservation token %q", opts.ReservationToken)
+		}
+		relayed, err := addrFromNet(conn.LocalAddr())
+		return conn, relayed, "", err
+	}
+	alloc := a.ports.Alloc
+	if opts.EvenPort {
+		alloc = a.ports.AllocEven
+	}
+	conn, err := alloc(network, a.ip)
+	if err != nil {
+		return nil, Addr{}, "", errors.Wrap(err, "failed to allocate relay socket")
+	}
+	relayed, err := addrFromNet(conn.LocalAddr())
+	if err != nil {
+		conn.Close() // nolint:errcheck
+		return nil, Addr{}, "", err
+	}
+	var token string
+	if opts.EvenPort && opts.NextPort {
+		next, err := net.ListenPacket(network, net.JoinHostPort(relayed.IP.String(), strconv.Itoa(relayed.Port+1)))
+		if err != nil {
+			a.log.Warn("failed to reserve next port", zap.Error(err))
+		} else {
+			token = a.addReservation(next)
+		}
+	}
+	return conn, relayed, token, nil
+}
+
+func (a *NetAllocator) addReservation(conn net.PacketConn) string {
+	token := randomToken()
+	a.mux.Lock()
+	a.reservations[token] = reservation{conn: conn, deadline: time.Now().Add(reservationLifetime)}
+	a.mux.Unlock()
+	return token
+}
+
+func (a *NetAllocator) takeReservation(token string) (net.PacketConn, bool) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	r, ok := a.reservations[token]
+	if !ok {
+		return nil, false
+	}
+	delete(a.reservations, token)
+	if time.Now().After(r.deadline) {
+		r.conn.Close() // nolint:errcheck
+		return nil, false
+	}
+	return r.conn, true
+}
+
+// Collect closes reserved ports that were never claimed before t.
+func (a *NetAllocator) Collect(t time.Time) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	for token, r := range a.reservations {
+		if t.After(r.deadline) {
+			r.conn.Close() // nolint:errcheck
+			delete(a.reservations, token)
+		}
+	}
+}
+
+func randomToken() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err) // crypto/rand failing is unrecoverable
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func addrFromNet(n net.Addr) (Addr, error) {
+	host, port, err := net.SplitHostPort(n.String())
+	if err != nil {
+		return Addr{}, errors.Wrap(err, "failed to parse net.Addr")
+	}
+	p, err := parsePort(port)
+	if err != nil {
+		return Addr{}, err
+	}
+	return Addr{IP: net.ParseIP(host), Port: p}, nil
+}
+
+func parsePort(s string) (int, error) {
+	p, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to parse port")
+	}
+	return p, nil
+}
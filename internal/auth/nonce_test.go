@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUNonceManager_Validate(t *testing.T) {
+	m := NewLRUNonceManager(time.Hour)
+	nonce := m.New("client")
+	if !m.Validate("client", nonce) {
+		t.Fatal("freshly issued nonce should validate")
+	}
+	if m.Validate("client", "bogus") {
+		t.Fatal("unknown nonce should not validate")
+	}
+	if m.Validate("other-client", nonce) {
+		t.Fatal("nonce should be scoped to the client it was issued to")
+	}
+}
+
+func TestLRUNonceManager_Expiry(t *testing.T) {
+	m := NewLRUNonceManager(time.Millisecond)
+	nonce := m.New("client")
+	time.Sleep(5 * time.Millisecond)
+	if m.Validate("client", nonce) {
+		t.Fatal("expired nonce should not validate")
+	}
+}
+
+func TestLRUNonceManager_Collect(t *testing.T) {
+	m := NewLRUNonceManager(time.Millisecond)
+	m.New("client")
+	m.Collect(time.Now().Add(time.Hour))
+	if len(m.byClient) != 0 {
+		t.Fatal("Collect should forget expired nonces")
+	}
+}
+
+func TestLRUNonceManager_DefaultLifetime(t *testing.T) {
+	m := NewLRUNonceManager(0)
+	if m.lifetime != DefaultNonceLifetime {
+		t.Fatalf("got lifetime %s, want %s", m.lifetime, DefaultNonceLifetime)
+	}
+}
@@ -1,52 +1,183 @@
 package server
 
 import (
+	"bufio"
+	"encoding/binary"
+	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 
 	"github.com/gortc/gortcd/internal/allocator"
+	"github.com/gortc/gortcd/internal/auth"
 	"github.com/gortc/stun"
 	"github.com/gortc/turn"
 )
 
+// defaultRealm is used when Options.Realm is empty.
+const defaultRealm = "realm"
+
+// channelDataHeaderSize is the size of the ChannelData message header:
+// a 16-bit channel number followed by a 16-bit length, per RFC 5766
+// Section 11.4.
+const channelDataHeaderSize = 4
+
+// channelBindLifetime is the lifetime of a channel binding, refreshed
+// on every successful ChannelBind request, per RFC 5766 Section 11.
+const channelBindLifetime = 10 * time.Minute
+
+// channelBindRequest is not predefined by package turn, so it is
+// constructed locally from its STUN method and class, per RFC 5766
+// Section 11.1.
+var channelBindRequest = stun.NewType(stun.MethodChannelBind, stun.ClassRequest)
+
+// codeUnsupportedTransportProtocol is TURN's 442 (Unsupported
+// Transport Protocol) error code, not predefined by package stun or
+// turn, per RFC 5766 Section 6.2.
+const codeUnsupportedTransportProtocol = stun.ErrorCode(442)
+
+// defaultAllocationLifetime is used when a Refresh request omits a
+// LIFETIME attribute, per RFC 5766 Section 2.2.
+const defaultAllocationLifetime = 10 * time.Minute
+
+// isChannelData reports whether b looks like a ChannelData message.
+// The two most significant bits of the channel number are 0b01,
+// distinguishing it from a STUN message, whose leading two bits are
+// always 0b00.
+func isChannelData(b []byte) bool {
+	return len(b) >= channelDataHeaderSize && b[0]&0xC0 == 0x40
+}
+
+func decodeChannelData(b []byte) (number uint16, data []byte, err error) {
+	if !isChannelData(b) {
+		return 0, nil, errors.New("not a channel data message")
+	}
+	number = binary.BigEndian.Uint16(b[0:2])
+	length := binary.BigEndian.Uint16(b[2:4])
+	if int(length) > len(b)-channelDataHeaderSize {
+		return 0, nil, errors.New("truncated channel data message")
+	}
+	return number, b[channelDataHeaderSize : channelDataHeaderSize+int(length)], nil
+}
+
+func buildChannelData(number uint16, data []byte) []byte {
+	buf := make([]byte, channelDataHeaderSize+len(data))
+	binary.BigEndian.PutUint16(buf[0:2], number)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(data)))
+	copy(buf[channelDataHeaderSize:], data)
+	return buf
+}
+
+func addrFromNetAddr(addr net.Addr) (allocator.Addr, error) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return allocator.Addr{IP: a.IP, Port: a.Port}, nil
+	case *net.TCPAddr:
+		return allocator.Addr{IP: a.IP, Port: a.Port}, nil
+	default:
+		return allocator.Addr{}, errors.Errorf("unknown addr %s", addr)
+	}
+}
+
 // Server is RFC 5389 basic server implementation.
 //
-// Current implementation is UDP only and not utilizes FINGERPRINT mechanism,
-// nor ALTERNATE-SERVER, nor credentials mechanisms. It does not support
-// backwards compatibility with RFC 3489.
+// It does not utilize the ALTERNATE-SERVER mechanism. It does not support backwards
+// compatibility with RFC 3489.
 type Server struct {
 	log    *zap.Logger
 	allocs *allocator.Allocator
-	conn   net.PacketConn
 	auth   Auth
+	realm  stun.Realm
+	nonces auth.NonceManager
+
+	udpConn     net.PacketConn
+	tcpListener net.Listener
+	tlsListener net.Listener
+
+	streamMux sync.Mutex
+	streams   map[string]net.Conn
 }
 
+// Options configures a Server. At least one of UDPConn, TCPListener or
+// TLSListener must be set; RFC 5766 Section 2.1 lists UDP, TCP and
+// TLS-over-TCP as the required listening transports for a
+// general-purpose TURN server.
 type Options struct {
 	Log  *zap.Logger
 	Auth Auth
-	Conn net.PacketConn
+
+	// Realm is advertised to clients in REALM attributes. Defaults to
+	// "realm" if empty.
+	Realm string
+	// NonceManager issues and validates NONCE values. Defaults to a
+	// LRUNonceManager with NonceLifetime (or DefaultNonceLifetime).
+	NonceManager auth.NonceManager
+	// NonceLifetime is used to construct the default NonceManager and
+	// is ignored if NonceManager is set.
+	NonceLifetime time.Duration
+
+	UDPConn     net.PacketConn
+	TCPListener net.Listener
+	TLSListener net.Listener
+
+	// MaxLifetime bounds the allocation lifetime a client can obtain
+	// via Allocate/Refresh requests. Defaults to
+	// allocator.DefaultMaxLifetime.
+	MaxLifetime time.Duration
 }
 
 func New(o Options) (*Server, error) {
+	relayAddr, err := o.relayLocalAddr()
+	if err != nil {
+		return nil, err
+	}
 	netAlloc, err := allocator.NewNetAllocator(
-		o.Log.Named("port"), o.Conn.LocalAddr(), allocator.SystemPortAllocator{},
+		o.Log.Named("port"), relayAddr, allocator.SystemPortAllocator{},
 	)
 	if err != nil {
 		return nil, err
 	}
-	allocs := allocator.NewAllocator(o.Log.Named("allocator"), netAlloc)
+	allocs := allocator.NewAllocator(o.Log.Named("allocator"), netAlloc, o.MaxLifetime)
+	realm := o.Realm
+	if realm == "" {
+		realm = defaultRealm
+	}
+	nonces := o.NonceManager
+	if nonces == nil {
+		nonces = auth.NewLRUNonceManager(o.NonceLifetime)
+	}
 	s := &Server{
-		log:    o.Log,
-		auth:   o.Auth,
-		conn:   o.Conn,
-		allocs: allocs,
+		log:         o.Log,
+		auth:        o.Auth,
+		realm:       stun.NewRealm(realm),
+		nonces:      nonces,
+		allocs:      allocs,
+		udpConn:     o.UDPConn,
+		tcpListener: o.TCPListener,
+		tlsListener: o.TLSListener,
+		streams:     make(map[string]net.Conn),
 	}
 	return s, nil
 }
 
+// relayLocalAddr picks the address new relayed sockets are allocated
+// on, preferring the UDP listener if present.
+func (o Options) relayLocalAddr() (net.Addr, error) {
+	switch {
+	case o.UDPConn != nil:
+		return o.UDPConn.LocalAddr(), nil
+	case o.TCPListener != nil:
+		return o.TCPListener.Addr(), nil
+	case o.TLSListener != nil:
+		return o.TLSListener.Addr(), nil
+	default:
+		return nil, errors.New("at least one listener must be set")
+	}
+}
+
 type Auth interface {
 	Auth(m *stun.Message) (stun.MessageIntegrity, error)
 }
@@ -58,35 +189,36 @@ var (
 
 func (s *Server) collect(t time.Time) {
 	s.allocs.Collect(t)
+	s.nonces.Collect(t)
 }
 
 func (s *Server) sendByPermission(
 	data turn.Data,
-	client allocator.Addr,
+	t allocator.FiveTuple,
 	addr turn.PeerAddress,
 ) error {
 	s.log.Info("searching for allocation",
-		zap.Stringer("client", client),
+		zap.Stringer("t", t),
 		zap.Stringer("addr", addr),
 	)
-	_, err := s.allocs.Send(client, allocator.Addr(addr), data)
+	_, err := s.allocs.Send(t, allocator.Addr(addr), data)
 	return err
 }
 
 func (s *Server) HandlePeerData(d []byte, t allocator.FiveTuple, a allocator.Addr) {
-	destination := &net.UDPAddr{
-		IP:   t.Client.IP,
-		Port: t.Client.Port,
-	}
 	l := s.log.With(
 		zap.Stringer("t", t),
 		zap.Stringer("addr", a),
 		zap.Int("len", len(d)),
-		zap.Stringer("d", destination),
 	)
 	l.Info("got peer data")
-	if err := s.conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
-		l.Error("failed to SetWriteDeadline", zap.Error(err))
+	if number, ok := s.allocs.Channel(t, a); ok {
+		if err := s.writeToClient(t, buildChannelData(number, d)); err != nil {
+			l.Error("failed to write channel data", zap.Error(err))
+			return
+		}
+		l.Info("sent channel data from peer", zap.Uint16("channel", number))
+		return
 	}
 	m := stun.New()
 	if err := m.Build(
@@ -98,12 +230,33 @@ func (s *Server) HandlePeerData(d []byte, t allocator.FiveTuple, a allocator.Add
 		l.Error("failed to build", zap.Error(err))
 		return
 	}
-	if _, err := s.conn.WriteTo(m.Raw, destination); err != nil {
+	if err := s.writeToClient(t, m.Raw); err != nil {
 		l.Error("failed to write", zap.Error(err))
+		return
 	}
 	l.Info("sent data from peer", zap.Stringer("m", m))
 }
 
+// writeToClient delivers raw bytes to the client side of t, using the
+// shared UDP socket for UDP allocations or the client's own stream
+// connection for TCP/TLS allocations.
+func (s *Server) writeToClient(t allocator.FiveTuple, raw []byte) error {
+	if t.Proto == allocator.TransportUDP {
+		destination := &net.UDPAddr{IP: t.Client.IP, Port: t.Client.Port}
+		if err := s.udpConn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+			s.log.Error("failed to SetWriteDeadline", zap.Error(err))
+		}
+		_, err := s.udpConn.WriteTo(raw, destination)
+		return err
+	}
+	conn, ok := s.stream(t.Client)
+	if !ok {
+		return errors.Errorf("no stream connection for client %s", t.Client)
+	}
+	_, err := conn.Write(raw)
+	return err
+}
+
 func (s *Server) processBindingRequest(ctx context) error {
 	return ctx.buildOk(
 		(*stun.XORMappedAddress)(&ctx.client),
@@ -111,16 +264,25 @@ func (s *Server) processBindingRequest(ctx context) error {
 }
 
 type context struct {
-	time      time.Time
-	client    allocator.Addr
-	request   *stun.Message
-	response  *stun.Message
+	time     time.Time
+	client   allocator.Addr
+	server   allocator.Addr
+	proto    allocator.Transport
+	request  *stun.Message
+	response *stun.Message
+
 	nonce     stun.Nonce
 	realm     stun.Realm
 	integrity stun.MessageIntegrity
 	software  stun.Software
 }
 
+// tuple returns the five-tuple identifying the allocation this request
+// belongs to.
+func (c context) tuple() allocator.FiveTuple {
+	return allocator.FiveTuple{Client: c.client, Server: c.server, Proto: c.proto}
+}
+
 func (c context) apply(s ...stun.Setter) error {
 	for _, a := range s {
 		if err := a.AddTo(c.response); err != nil {
@@ -146,8 +308,8 @@ func (c context) buildOk(s ...stun.Setter) error {
 
 func (c context) build(t stun.MessageType, s ...stun.Setter) error {
 	c.response.Reset()
-	c.response.WriteHeader()
 	copy(c.response.TransactionID[:], c.request.TransactionID[:])
+	c.response.WriteHeader()
 	if err := c.apply(t, &c.nonce, &c.realm); err != nil {
 		return err
 	}
@@ -170,45 +332,72 @@ func (c context) build(t stun.MessageType, s ...stun.Setter) error {
 func (s *Server) processAllocateRequest(ctx context) error {
 	var (
 		transport turn.RequestedTransport
+		lifetime  turn.Lifetime
+		evenPort  turn.EvenPort
+		token     turn.ReservationToken
+		opts      allocator.AllocOptions
 	)
 	if err := transport.GetFrom(ctx.request); err != nil {
 		return ctx.buildErr(stun.CodeBadRequest)
 	}
-	server, err := s.allocs.New(
-		ctx.client, transport.Protocol, s,
-	)
+	if transport.Protocol != turn.ProtoUDP {
+		// RFC 5766 Section 6.2 requires UDP; relaying any other
+		// protocol is unsupported.
+		return ctx.buildErr(codeUnsupportedTransportProtocol)
+	}
+	switch err := lifetime.GetFrom(ctx.request); err {
+	case nil, stun.ErrAttributeNotFound:
+	default:
+		return errors.Wrap(err, "failed to get lifetime")
+	}
+	switch err := evenPort.GetFrom(ctx.request); err {
+	case nil:
+		opts.EvenPort = true
+		opts.NextPort = evenPort.ReservePort
+	case stun.ErrAttributeNotFound:
+	default:
+		return errors.Wrap(err, "failed to get even port")
+	}
+	switch err := token.GetFrom(ctx.request); err {
+	case nil:
+		opts.ReservationToken = string(token)
+	case stun.ErrAttributeNotFound:
+	default:
+		return errors.Wrap(err, "failed to get reservation token")
+	}
+	if opts.ReservationToken != "" && opts.EvenPort {
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	relayed, reservation, err := s.allocs.New(ctx.tuple(), opts, lifetime.Duration, s)
 	if err != nil {
+		if err == allocator.ErrAllocationMismatch {
+			return ctx.buildErr(stun.CodeAllocMismatch)
+		}
 		s.log.Error("failed to allocate", zap.Error(err))
 		return ctx.buildErr(stun.CodeServerError)
 	}
-	return ctx.buildOk(
-		(*stun.XORMappedAddress)(&server),
-		(*turn.RelayedAddress)(&ctx.client),
-	)
+	setters := []stun.Setter{
+		(*turn.RelayedAddress)(&relayed),
+		(*stun.XORMappedAddress)(&ctx.client),
+	}
+	if reservation != "" {
+		setters = append(setters, turn.ReservationToken(reservation))
+	}
+	return ctx.buildOk(setters...)
 }
 
 func (s *Server) processRefreshRequest(ctx context) error {
-	var (
-		addr     turn.PeerAddress
-		lifetime turn.Lifetime
-	)
-	if err := ctx.request.Parse(&addr); err != nil && err != stun.ErrAttributeNotFound {
-		return errors.Wrap(err, "failed to parse refresh request")
-	}
-	if err := ctx.request.Parse(&addr); err != nil {
-		if err != stun.ErrAttributeNotFound {
-			return errors.Wrap(err, "failed to parse")
-		}
-	}
-	switch lifetime.Duration {
-	case 0:
-		s.allocs.Remove(ctx.client)
+	var lifetime turn.Lifetime
+	switch err := lifetime.GetFrom(ctx.request); err {
+	case nil:
+	case stun.ErrAttributeNotFound:
+		lifetime.Duration = defaultAllocationLifetime
 	default:
-		t := ctx.time.Add(lifetime.Duration)
-		if err := s.allocs.Refresh(ctx.client, allocator.Addr(addr), t); err != nil {
-			s.log.Error("failed to refresh allocation", zap.Error(err))
-			return ctx.buildErr(stun.CodeServerError)
-		}
+		return errors.Wrap(err, "failed to get lifetime")
+	}
+	if err := s.allocs.Refresh(ctx.tuple(), ctx.time, lifetime.Duration); err != nil {
+		s.log.Error("failed to refresh allocation", zap.Error(err))
+		return ctx.buildErr(stun.CodeServerError)
 	}
 	return ctx.buildOk()
 }
@@ -233,12 +422,29 @@ func (s *Server) processCreatePermissionRequest(ctx context) error {
 		return errors.Wrap(err, "failed to get lifetime")
 	}
 	s.log.Info("processing create permission request")
-	if err := s.allocs.CreatePermission(ctx.client, allocator.Addr(addr), ctx.time.Add(lifetime.Duration)); err != nil {
+	if err := s.allocs.CreatePermission(ctx.tuple(), allocator.Addr(addr), ctx.time.Add(lifetime.Duration)); err != nil {
 		return errors.Wrap(err, "failed to create allocation")
 	}
 	return ctx.buildOk()
 }
 
+func (s *Server) processChannelBindRequest(ctx context) error {
+	var (
+		addr   turn.PeerAddress
+		number turn.ChannelNumber
+	)
+	if err := ctx.request.Parse(&addr, &number); err != nil {
+		return errors.Wrap(err, "failed to parse channel bind request")
+	}
+	if err := s.allocs.ChannelBind(
+		ctx.tuple(), allocator.Addr(addr), uint16(number), ctx.time.Add(channelBindLifetime),
+	); err != nil {
+		s.log.Warn("channel bind failed", zap.Error(err))
+		return ctx.buildErr(stun.CodeBadRequest)
+	}
+	return ctx.buildOk()
+}
+
 func (s *Server) processSendIndication(ctx context) error {
 	var (
 		data turn.Data
@@ -247,7 +453,7 @@ func (s *Server) processSendIndication(ctx context) error {
 	if err := ctx.request.Parse(&data, &addr); err != nil {
 		return errors.Wrap(err, "failed to parse send indication")
 	}
-	if err := s.sendByPermission(data, ctx.client, addr); err != nil {
+	if err := s.sendByPermission(data, ctx.tuple(), addr); err != nil {
 		s.log.Warn("send failed",
 			zap.Error(err),
 		)
@@ -255,15 +461,66 @@ func (s *Server) processSendIndication(ctx context) error {
 	return nil
 }
 
+// processChannelData forwards a ChannelData message to the peer bound
+// to its channel number, per RFC 5766 Section 11.4. local and proto
+// identify the server side of the five-tuple the message arrived on.
+func (s *Server) processChannelData(local net.Addr, proto allocator.Transport, addr net.Addr, b []byte) {
+	client, err := addrFromNetAddr(addr)
+	if err != nil {
+		s.log.Error("unknown addr", zap.Error(err))
+		return
+	}
+	server, err := addrFromNetAddr(local)
+	if err != nil {
+		s.log.Error("unknown local addr", zap.Error(err))
+		return
+	}
+	t := allocator.FiveTuple{Client: client, Server: server, Proto: proto}
+	number, data, err := decodeChannelData(b)
+	if err != nil {
+		s.log.Warn("failed to decode channel data", zap.Error(err))
+		return
+	}
+	peer, ok := s.allocs.ChannelPeer(t, number)
+	if !ok {
+		s.log.Warn("unknown channel", zap.Uint16("number", number))
+		return
+	}
+	if _, err := s.allocs.Send(t, peer, data); err != nil {
+		s.log.Warn("channel send failed", zap.Error(err))
+	}
+}
+
 func (s *Server) needAuth(ctx context) bool {
 	return ctx.request.Type != stun.BindingRequest
 }
 
-func (s *Server) process(addr net.Addr, b []byte, req, res *stun.Message) error {
-	var (
-		nonce       = stun.NewNonce("nonce")
-		serverRealm = stun.NewRealm("realm")
-	)
+// checkNonce extracts the client's NONCE attribute and validates it
+// against s.nonces. If the nonce is missing, unknown or expired, it
+// builds the appropriate challenge response into ctx and returns
+// handled=true so the caller stops dispatching the request. Otherwise
+// it stashes the accepted nonce on ctx for the success response and
+// returns handled=false.
+func (s *Server) checkNonce(ctx *context) (handled bool, err error) {
+	var n stun.Nonce
+	key := ctx.tuple().String()
+	switch err := n.GetFrom(ctx.request); err {
+	case nil:
+		if s.nonces.Validate(key, string(n)) {
+			ctx.nonce = n
+			return false, nil
+		}
+		ctx.nonce = stun.NewNonce(s.nonces.New(key))
+		return true, ctx.buildErr(stun.CodeStaleNonce)
+	case stun.ErrAttributeNotFound:
+		ctx.nonce = stun.NewNonce(s.nonces.New(key))
+		return true, ctx.buildErr(stun.CodeUnauthorised)
+	default:
+		return true, errors.Wrap(err, "failed to get nonce")
+	}
+}
+
+func (s *Server) process(addr, local net.Addr, proto allocator.Transport, b []byte, req, res *stun.Message) error {
 	if !stun.IsMessage(b) {
 		s.log.Debug("not looks like stun message", zap.Stringer("addr", addr))
 		return errNotSTUNMessage
@@ -275,23 +532,30 @@ func (s *Server) process(addr net.Addr, b []byte, req, res *stun.Message) error
 		time:     time.Now(),
 		response: res,
 		request:  req,
-		realm:    serverRealm,
-		nonce:    nonce,
+		realm:    s.realm,
 		software: software,
+		proto:    proto,
 	}
-	switch a := addr.(type) {
-	case *net.UDPAddr:
-		ctx.client.IP = a.IP
-		ctx.client.Port = a.Port
-	default:
-		s.log.Error("unknown addr", zap.Stringer("addr", addr))
-		return errors.Errorf("unknown addr %s", addr)
+	client, err := addrFromNetAddr(addr)
+	if err != nil {
+		s.log.Error("unknown addr", zap.Error(err))
+		return err
 	}
+	server, err := addrFromNetAddr(local)
+	if err != nil {
+		s.log.Error("unknown local addr", zap.Error(err))
+		return err
+	}
+	ctx.client = client
+	ctx.server = server
 	s.log.Info("got message",
 		zap.Stringer("m", req),
 		zap.Stringer("addr", ctx.client),
 	)
 	if s.needAuth(ctx) {
+		if handled, err := s.checkNonce(&ctx); handled {
+			return err
+		}
 		integrity, err := s.auth.Auth(ctx.request)
 		if err != nil {
 			return ctx.buildErr(stun.CodeUnauthorised)
@@ -307,6 +571,8 @@ func (s *Server) process(addr net.Addr, b []byte, req, res *stun.Message) error
 		return s.processCreatePermissionRequest(ctx)
 	case turn.RefreshRequest:
 		return s.processRefreshRequest(ctx)
+	case channelBindRequest:
+		return s.processChannelBindRequest(ctx)
 	case turn.SendIndication:
 		return s.processSendIndication(ctx)
 	default:
@@ -329,11 +595,15 @@ func (s *Server) serveConn(c net.PacketConn, res, req *stun.Message) error {
 		zap.Int("n", n),
 		zap.Stringer("addr", addr),
 	)
+	if isChannelData(buf[:n]) {
+		s.processChannelData(c.LocalAddr(), allocator.TransportUDP, addr, buf[:n])
+		return nil
+	}
 	if _, err = req.Write(buf[:n]); err != nil {
 		s.log.Warn("write failed", zap.Error(err))
 		return err
 	}
-	if err = s.process(addr, buf[:n], req, res); err != nil {
+	if err = s.process(addr, c.LocalAddr(), allocator.TransportUDP, buf[:n], req, res); err != nil {
 		if err == errNotSTUNMessage {
 			return nil
 		}
@@ -351,17 +621,164 @@ func (s *Server) serveConn(c net.PacketConn, res, req *stun.Message) error {
 	return err
 }
 
-// Serve reads packets from connections and responds to BINDING requests.
-func (s *Server) Serve() error {
+// stunHeaderSize is the size of the fixed STUN message header: a
+// 2-byte type, a 2-byte length, a 4-byte magic cookie and a 12-byte
+// transaction ID, per RFC 5389 Section 6.
+const stunHeaderSize = 20
+
+// readFrame reads a single STUN or ChannelData message from r, using
+// the message's own length field to find its boundary. This is
+// required on stream transports, which have no message boundaries of
+// their own.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	header, err := r.Peek(channelDataHeaderSize)
+	if err != nil {
+		return nil, err
+	}
+	var total int
+	if isChannelData(header) {
+		length := int(binary.BigEndian.Uint16(header[2:4]))
+		total = channelDataHeaderSize + length
+		// ChannelData messages are padded to a multiple of four bytes
+		// on stream transports, per RFC 5766 Section 11.4.
+		if rem := total % 4; rem != 0 {
+			total += 4 - rem
+		}
+	} else {
+		header, err = r.Peek(stunHeaderSize)
+		if err != nil {
+			return nil, err
+		}
+		total = stunHeaderSize + int(binary.BigEndian.Uint16(header[2:4]))
+	}
+	buf := make([]byte, total)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *Server) addStream(client allocator.Addr, conn net.Conn) {
+	s.streamMux.Lock()
+	s.streams[client.String()] = conn
+	s.streamMux.Unlock()
+}
+
+func (s *Server) removeStream(client allocator.Addr) {
+	s.streamMux.Lock()
+	delete(s.streams, client.String())
+	s.streamMux.Unlock()
+}
+
+func (s *Server) stream(client allocator.Addr) (net.Conn, bool) {
+	s.streamMux.Lock()
+	conn, ok := s.streams[client.String()]
+	s.streamMux.Unlock()
+	return conn, ok
+}
+
+// serveStream handles a single accepted TCP or TLS connection, framing
+// and dispatching STUN/ChannelData messages until the connection is
+// closed by the peer or a read error occurs.
+func (s *Server) serveStream(conn net.Conn, proto allocator.Transport) {
+	defer conn.Close() // nolint:errcheck
+	client, err := addrFromNetAddr(conn.RemoteAddr())
+	if err != nil {
+		s.log.Error("unknown addr", zap.Error(err))
+		return
+	}
+	s.addStream(client, conn)
+	defer s.removeStream(client)
+	var (
+		r   = bufio.NewReader(conn)
+		res = new(stun.Message)
+		req = new(stun.Message)
+	)
+	for {
+		b, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				s.log.Warn("readFrame failed", zap.Error(err))
+			}
+			return
+		}
+		if isChannelData(b) {
+			s.processChannelData(conn.LocalAddr(), proto, conn.RemoteAddr(), b)
+			continue
+		}
+		if _, err := req.Write(b); err != nil {
+			s.log.Warn("write failed", zap.Error(err))
+			continue
+		}
+		if err := s.process(conn.RemoteAddr(), conn.LocalAddr(), proto, b, req, res); err != nil {
+			if err != errNotSTUNMessage {
+				s.log.Error("process failed", zap.Error(err))
+			}
+			res.Reset()
+			req.Reset()
+			continue
+		}
+		if len(res.Raw) > 0 {
+			if _, err := conn.Write(res.Raw); err != nil {
+				s.log.Warn("write failed", zap.Error(err))
+				return
+			}
+		}
+		res.Reset()
+		req.Reset()
+	}
+}
+
+func (s *Server) serveListener(l net.Listener, proto allocator.Transport) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.log.Error("accept failed", zap.Error(err))
+			return
+		}
+		go s.serveStream(conn, proto)
+	}
+}
+
+func (s *Server) serveUDP() {
 	var (
 		res = new(stun.Message)
 		req = new(stun.Message)
 	)
 	for {
-		if err := s.serveConn(s.conn, res, req); err != nil {
+		if err := s.serveConn(s.udpConn, res, req); err != nil {
 			s.log.Error("serveConn failed", zap.Error(err))
 		}
 		res.Reset()
 		req.Reset()
 	}
 }
+
+// Serve spawns one goroutine per configured listener and blocks until
+// all of them return.
+func (s *Server) Serve() error {
+	var wg sync.WaitGroup
+	if s.udpConn != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveUDP()
+		}()
+	}
+	if s.tcpListener != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveListener(s.tcpListener, allocator.TransportTCP)
+		}()
+	}
+	if s.tlsListener != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveListener(s.tlsListener, allocator.TransportTLS)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gortc/stun"
+
+	"github.com/gortc/gortcd/internal/allocator"
+	"github.com/gortc/gortcd/internal/auth"
+)
+
+func newCheckNonceContext(req, res *stun.Message) context {
+	return context{
+		client:   allocator.Addr{IP: net.ParseIP("127.0.0.1"), Port: 1234},
+		request:  req,
+		response: res,
+		realm:    stun.NewRealm("realm"),
+		software: software,
+	}
+}
+
+// TestServer_checkNonce_staleNonceRetry asserts a client can recover
+// from a 438 (Stale Nonce) challenge by retrying with the NONCE the
+// server handed back, per RFC 5766 Section 4.
+func TestServer_checkNonce_staleNonceRetry(t *testing.T) {
+	s := &Server{nonces: auth.NewLRUNonceManager(time.Hour)}
+
+	// No NONCE at all: server challenges with 401 and a fresh nonce.
+	req := new(stun.Message)
+	if err := req.Build(stun.TransactionID, stun.BindingRequest); err != nil {
+		t.Fatal(err)
+	}
+	res := new(stun.Message)
+	ctx := newCheckNonceContext(req, res)
+	handled, err := s.checkNonce(&ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !handled {
+		t.Fatal("expected missing nonce to be handled")
+	}
+	var code stun.ErrorCodeAttribute
+	if err := code.GetFrom(res); err != nil {
+		t.Fatal(err)
+	}
+	if code.Code != stun.CodeUnauthorised {
+		t.Fatalf("got code %d, want %d", code.Code, stun.CodeUnauthorised)
+	}
+
+	// Retrying with a stale (unknown) nonce gets a 438 challenge with a
+	// new nonce.
+	stale := stun.NewNonce("stale")
+	staleReq := new(stun.Message)
+	if err := staleReq.Build(stun.TransactionID, stun.BindingRequest, &stale); err != nil {
+		t.Fatal(err)
+	}
+	staleRes := new(stun.Message)
+	staleCtx := newCheckNonceContext(staleReq, staleRes)
+	handled, err = s.checkNonce(&staleCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !handled {
+		t.Fatal("expected stale nonce to be handled")
+	}
+	var staleCode stun.ErrorCodeAttribute
+	if err := staleCode.GetFrom(staleRes); err != nil {
+		t.Fatal(err)
+	}
+	if staleCode.Code != stun.CodeStaleNonce {
+		t.Fatalf("got code %d, want %d", staleCode.Code, stun.CodeStaleNonce)
+	}
+	var retryNonce stun.Nonce
+	if err := retryNonce.GetFrom(staleRes); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retrying again with the nonce from the 438 challenge succeeds.
+	retryReq := new(stun.Message)
+	if err := retryReq.Build(stun.TransactionID, stun.BindingRequest, &retryNonce); err != nil {
+		t.Fatal(err)
+	}
+	retryRes := new(stun.Message)
+	retryCtx := newCheckNonceContext(retryReq, retryRes)
+	handled, err = s.checkNonce(&retryCtx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handled {
+		t.Fatal("expected the fresh nonce to be accepted")
+	}
+}
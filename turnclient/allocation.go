@@ -0,0 +1,332 @@
+package turnclient
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/gortc/stun"
+	"github.com/gortc/turn"
+)
+
+// defaultAllocationLifetime is used when Allocate's response omits a
+// LIFETIME attribute.
+const defaultAllocationLifetime = 10 * time.Minute
+
+// channelBindRequest is not predefined by package turn, so it is
+// constructed locally from its STUN method and class, per RFC 5766
+// Section 11.1.
+var channelBindRequest = stun.NewType(stun.MethodChannelBind, stun.ClassRequest)
+
+// channelRebindInterval is how often bound channels (and the
+// permissions backing them) are refreshed, independent of the
+// allocation's own refresh cycle.
+const channelRebindInterval = 5 * time.Minute
+
+// channelMinNumber is the first channel number handed out by
+// BindChannel, per RFC 5766 Section 11.
+const channelMinNumber = 0x4000
+
+// channelDataHeaderSize is the size of the ChannelData message header:
+// a 16-bit channel number followed by a 16-bit length, per RFC 5766
+// Section 11.4.
+const channelDataHeaderSize = 4
+
+func isChannelData(b []byte) bool {
+	return len(b) >= channelDataHeaderSize && b[0]&0xC0 == 0x40
+}
+
+func decodeChannelData(b []byte) (number uint16, data []byte, err error) {
+	if !isChannelData(b) {
+		return 0, nil, errors.New("not a channel data message")
+	}
+	number = binary.BigEndian.Uint16(b[0:2])
+	length := binary.BigEndian.Uint16(b[2:4])
+	if int(length) > len(b)-channelDataHeaderSize {
+		return 0, nil, errors.New("truncated channel data message")
+	}
+	return number, b[channelDataHeaderSize : channelDataHeaderSize+int(length)], nil
+}
+
+func buildChannelData(number uint16, data []byte) []byte {
+	buf := make([]byte, channelDataHeaderSize+len(data))
+	binary.BigEndian.PutUint16(buf[0:2], number)
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(data)))
+	copy(buf[channelDataHeaderSize:], data)
+	return buf
+}
+
+func peerAddress(a net.Addr) (turn.PeerAddress, error) {
+	udp, ok := a.(*net.UDPAddr)
+	if !ok {
+		return turn.PeerAddress{}, errors.Errorf("unsupported peer address type %T", a)
+	}
+	return turn.PeerAddress{IP: udp.IP, Port: udp.Port}, nil
+}
+
+func (c *Client) handleChannelData(b []byte) {
+	number, data, err := decodeChannelData(b)
+	if err != nil {
+		c.log.Warn("failed to decode channel data", zap.Error(err))
+		return
+	}
+	c.allocMux.Lock()
+	alloc := c.alloc
+	c.allocMux.Unlock()
+	if alloc == nil {
+		return
+	}
+	peer, ok := alloc.peerForChannel(number)
+	if !ok {
+		c.log.Warn("dropping channel data for unknown channel", zap.Uint16("number", number))
+		return
+	}
+	alloc.deliver(append([]byte(nil), data...), peer)
+}
+
+type incomingPacket struct {
+	data []byte
+	peer net.Addr
+}
+
+// Allocation is a relayed transport address obtained via
+// Client.Allocate. It implements net.PacketConn so it can be used like
+// a regular socket, with additional methods for the TURN-specific
+// permission and channel-binding mechanisms.
+type Allocation struct {
+	client  *Client
+	relayed net.Addr
+
+	mux      sync.Mutex
+	lifetime time.Duration
+
+	permMux     sync.Mutex
+	permissions map[string]time.Time
+
+	chanMux  sync.Mutex
+	channels map[string]uint16
+	byNumber map[uint16]net.Addr
+	nextChan uint16
+
+	incoming chan incomingPacket
+	done     chan struct{}
+}
+
+func newAllocation(c *Client, relayed net.Addr, lifetime time.Duration) *Allocation {
+	return &Allocation{
+		client:      c,
+		relayed:     relayed,
+		lifetime:    lifetime,
+		permissions: make(map[string]time.Time),
+		channels:    make(map[string]uint16),
+		byNumber:    make(map[uint16]net.Addr),
+		nextChan:    channelMinNumber,
+		incoming:    make(chan incomingPacket, 64),
+		done:        make(chan struct{}),
+	}
+}
+
+// LocalAddr returns the relayed transport address peers see.
+func (a *Allocation) LocalAddr() net.Addr { return a.relayed }
+
+func (a *Allocation) deliver(data []byte, peer net.Addr) {
+	select {
+	case a.incoming <- incomingPacket{data: data, peer: peer}:
+	default:
+		a.client.log.Warn("dropping peer data, incoming queue full")
+	}
+}
+
+func (a *Allocation) peerForChannel(number uint16) (net.Addr, bool) {
+	a.chanMux.Lock()
+	defer a.chanMux.Unlock()
+	peer, ok := a.byNumber[number]
+	return peer, ok
+}
+
+func (a *Allocation) channelNumber(peer net.Addr) (uint16, bool) {
+	a.chanMux.Lock()
+	defer a.chanMux.Unlock()
+	number, ok := a.channels[peer.String()]
+	return number, ok
+}
+
+// ReadFrom blocks until data relayed from a peer is available.
+func (a *Allocation) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case pkt := <-a.incoming:
+		return copy(p, pkt.data), pkt.peer, nil
+	case <-a.done:
+		return 0, nil, errors.New("allocation closed")
+	}
+}
+
+// WriteTo relays p to peer, creating a permission first if one does
+// not already exist. If peer has a bound channel, the data is sent as
+// a ChannelData frame instead of a Send indication.
+func (a *Allocation) WriteTo(p []byte, peer net.Addr) (int, error) {
+	if number, ok := a.channelNumber(peer); ok {
+		if _, err := a.client.conn.WriteTo(buildChannelData(number, p), a.client.turnAddr); err != nil {
+			return 0, errors.Wrap(err, "failed to send channel data")
+		}
+		return len(p), nil
+	}
+	if !a.hasPermission(peer) {
+		if err := a.CreatePermission(peer); err != nil {
+			return 0, errors.Wrap(err, "failed to create permission")
+		}
+	}
+	addr, err := peerAddress(peer)
+	if err != nil {
+		return 0, err
+	}
+	m, err := a.client.authenticatedMessage(turn.SendIndication, turn.Data(p), (*turn.PeerAddress)(&addr))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to build send indication")
+	}
+	if _, err := a.client.conn.WriteTo(m.Raw, a.client.turnAddr); err != nil {
+		return 0, errors.Wrap(err, "failed to send data")
+	}
+	return len(p), nil
+}
+
+func (a *Allocation) hasPermission(peer net.Addr) bool {
+	a.permMux.Lock()
+	defer a.permMux.Unlock()
+	_, ok := a.permissions[peer.String()]
+	return ok
+}
+
+// CreatePermission installs a permission for peer, allowing data to be
+// relayed to and from it, per RFC 5766 Section 9.
+func (a *Allocation) CreatePermission(peer net.Addr) error {
+	addr, err := peerAddress(peer)
+	if err != nil {
+		return err
+	}
+	if _, err := a.client.doAuth(turn.CreatePermissionRequest, (*turn.PeerAddress)(&addr)); err != nil {
+		return err
+	}
+	a.permMux.Lock()
+	a.permissions[peer.String()] = time.Now().Add(time.Minute)
+	a.permMux.Unlock()
+	return nil
+}
+
+// BindChannel binds the next free channel number to peer, creating a
+// permission first if needed, per RFC 5766 Section 11.1. Binding the
+// same peer twice returns its existing channel number.
+func (a *Allocation) BindChannel(peer net.Addr) (uint16, error) {
+	if number, ok := a.channelNumber(peer); ok {
+		return number, nil
+	}
+	if !a.hasPermission(peer) {
+		if err := a.CreatePermission(peer); err != nil {
+			return 0, err
+		}
+	}
+	a.chanMux.Lock()
+	number := a.nextChan
+	a.nextChan++
+	a.chanMux.Unlock()
+
+	if err := a.sendChannelBind(peer, number); err != nil {
+		return 0, err
+	}
+	a.chanMux.Lock()
+	a.channels[peer.String()] = number
+	a.byNumber[number] = peer
+	a.chanMux.Unlock()
+	return number, nil
+}
+
+func (a *Allocation) sendChannelBind(peer net.Addr, number uint16) error {
+	addr, err := peerAddress(peer)
+	if err != nil {
+		return err
+	}
+	_, err = a.client.doAuth(channelBindRequest, (*turn.PeerAddress)(&addr), turn.ChannelNumber(number))
+	return errors.Wrap(err, "failed to bind channel")
+}
+
+// keepAlive refreshes the allocation at 3/4 of its lifetime and
+// rebinds channels every channelRebindInterval, until the allocation
+// is closed.
+func (a *Allocation) keepAlive() {
+	a.mux.Lock()
+	lifetime := a.lifetime
+	a.mux.Unlock()
+	refresh := time.NewTicker(lifetime * 3 / 4)
+	rebind := time.NewTicker(channelRebindInterval)
+	defer refresh.Stop()
+	defer rebind.Stop()
+	for {
+		select {
+		case <-refresh.C:
+			if err := a.refresh(); err != nil {
+				a.client.log.Warn("failed to refresh allocation", zap.Error(err))
+			}
+		case <-rebind.C:
+			a.rebindChannels()
+		case <-a.done:
+			return
+		}
+	}
+}
+
+func (a *Allocation) refresh() error {
+	a.mux.Lock()
+	lifetime := a.lifetime
+	a.mux.Unlock()
+	_, err := a.client.doAuth(turn.RefreshRequest, turn.Lifetime{Duration: lifetime})
+	return errors.Wrap(err, "failed to refresh allocation")
+}
+
+func (a *Allocation) rebindChannels() {
+	a.chanMux.Lock()
+	peers := make([]net.Addr, 0, len(a.byNumber))
+	numbers := make([]uint16, 0, len(a.byNumber))
+	for number, peer := range a.byNumber {
+		peers = append(peers, peer)
+		numbers = append(numbers, number)
+	}
+	a.chanMux.Unlock()
+	for i, peer := range peers {
+		if err := a.sendChannelBind(peer, numbers[i]); err != nil {
+			a.client.log.Warn("failed to rebind channel", zap.Error(err))
+		}
+	}
+}
+
+func (a *Allocation) stop() {
+	select {
+	case <-a.done:
+	default:
+		close(a.done)
+	}
+}
+
+// Close stops the allocation's background refresh. It does not
+// deallocate it on the server; callers that need an immediate
+// deallocation should send a Refresh with a zero lifetime before
+// closing.
+func (a *Allocation) Close() error {
+	a.stop()
+	return nil
+}
+
+func (a *Allocation) SetDeadline(t time.Time) error {
+	return errors.New("turnclient: deadlines are not supported")
+}
+
+func (a *Allocation) SetReadDeadline(t time.Time) error {
+	return errors.New("turnclient: deadlines are not supported")
+}
+
+func (a *Allocation) SetWriteDeadline(t time.Time) error {
+	return errors.New("turnclient: deadlines are not supported")
+}
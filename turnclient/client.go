@@ -0,0 +1,345 @@
+// Package turnclient implements a minimal RFC 5766 TURN client, letting
+// Go applications allocate and use relayed transport addresses on a
+// gortcd (or any RFC 5766 compliant) server without shelling out to an
+// external tool. It also backs gortcd's own integration tests.
+package turnclient
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+
+	"github.com/gortc/stun"
+	"github.com/gortc/turn"
+)
+
+// defaultRTTimeout bounds how long a request waits for a matching
+// response before failing.
+const defaultRTTimeout = 5 * time.Second
+
+// Config configures a Client.
+type Config struct {
+	// STUNServerAddr and TURNServerAddr are "host:port" addresses.
+	// They are often the same server; they are kept distinct because
+	// a deployment may split STUN and TURN across different hosts.
+	STUNServerAddr string
+	TURNServerAddr string
+
+	// Username, Password and Realm are the long-term credentials used
+	// to answer 401/438 challenges, per RFC 5766 Section 4.
+	Username string
+	Password string
+	Realm    string
+
+	// Conn is the local socket the client sends and receives on. If
+	// nil, New opens a UDP socket on an ephemeral port.
+	Conn net.PacketConn
+
+	// Software is advertised in the SOFTWARE attribute of outgoing
+	// requests. Optional.
+	Software string
+
+	// Log is used for diagnostic logging. Defaults to a no-op logger.
+	Log *zap.Logger
+}
+
+// Client is a TURN client as described by RFC 5766. It supports a
+// single outstanding allocation at a time, mirroring the one
+// allocation per five-tuple model of the server it talks to.
+type Client struct {
+	log      *zap.Logger
+	conn     net.PacketConn
+	stunAddr net.Addr
+	turnAddr net.Addr
+
+	username stun.Username
+	password string
+	software stun.Software
+
+	mux   sync.Mutex
+	realm stun.Realm
+	nonce stun.Nonce
+
+	pendingMux sync.Mutex
+	pending    map[string]chan *stun.Message
+
+	allocMux sync.Mutex
+	alloc    *Allocation
+}
+
+// New resolves c's server addresses and returns a Client ready to have
+// Listen called on it.
+func New(c Config) (*Client, error) {
+	stunAddr, err := net.ResolveUDPAddr("udp", c.STUNServerAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve STUN server address")
+	}
+	turnAddr, err := net.ResolveUDPAddr("udp", c.TURNServerAddr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve TURN server address")
+	}
+	conn := c.Conn
+	if conn == nil {
+		conn, err = net.ListenPacket("udp", "0.0.0.0:0")
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to open local socket")
+		}
+	}
+	log := c.Log
+	if log == nil {
+		log = zap.NewNop()
+	}
+	cl := &Client{
+		log:      log,
+		conn:     conn,
+		stunAddr: stunAddr,
+		turnAddr: turnAddr,
+		username: stun.NewUsername(c.Username),
+		password: c.Password,
+		realm:    stun.NewRealm(c.Realm),
+		pending:  make(map[string]chan *stun.Message),
+	}
+	if c.Software != "" {
+		cl.software = stun.NewSoftware(c.Software)
+	}
+	return cl, nil
+}
+
+// Listen starts the background goroutine that reads responses,
+// indications and ChannelData frames from the underlying socket. It
+// must be called before any request method.
+func (c *Client) Listen() error {
+	go c.readLoop()
+	return nil
+}
+
+func (c *Client) readLoop() {
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			c.log.Debug("client socket closed", zap.Error(err))
+			return
+		}
+		b := append([]byte(nil), buf[:n]...)
+		if isChannelData(b) {
+			c.handleChannelData(b)
+			continue
+		}
+		if !stun.IsMessage(b) {
+			c.log.Warn("dropping non-stun datagram", zap.Stringer("addr", addr))
+			continue
+		}
+		m := new(stun.Message)
+		if _, err := m.Write(b); err != nil {
+			c.log.Warn("failed to parse message", zap.Error(err))
+			continue
+		}
+		if m.Type.Class == stun.ClassIndication {
+			c.handleIndication(m)
+			continue
+		}
+		c.deliver(m)
+	}
+}
+
+func (c *Client) deliver(m *stun.Message) {
+	key := string(m.TransactionID[:])
+	c.pendingMux.Lock()
+	ch, ok := c.pending[key]
+	c.pendingMux.Unlock()
+	if !ok {
+		c.log.Warn("dropping response with unknown transaction id")
+		return
+	}
+	ch <- m
+}
+
+func (c *Client) handleIndication(m *stun.Message) {
+	if m.Type != stun.NewType(stun.MethodData, stun.ClassIndication) {
+		return
+	}
+	var (
+		data turn.Data
+		addr turn.PeerAddress
+	)
+	if err := m.Parse(&data, &addr); err != nil {
+		c.log.Warn("failed to parse data indication", zap.Error(err))
+		return
+	}
+	c.deliverPeerData(append([]byte(nil), data...), &net.UDPAddr{IP: addr.IP, Port: addr.Port})
+}
+
+func (c *Client) deliverPeerData(data []byte, peer net.Addr) {
+	c.allocMux.Lock()
+	alloc := c.alloc
+	c.allocMux.Unlock()
+	if alloc == nil {
+		c.log.Warn("dropping peer data with no active allocation")
+		return
+	}
+	alloc.deliver(data, peer)
+}
+
+// roundTrip sends req to addr and waits for a response with a matching
+// transaction ID, or defaultRTTimeout.
+func (c *Client) roundTrip(req *stun.Message, addr net.Addr) (*stun.Message, error) {
+	key := string(req.TransactionID[:])
+	ch := make(chan *stun.Message, 1)
+	c.pendingMux.Lock()
+	c.pending[key] = ch
+	c.pendingMux.Unlock()
+	defer func() {
+		c.pendingMux.Lock()
+		delete(c.pending, key)
+		c.pendingMux.Unlock()
+	}()
+	if _, err := c.conn.WriteTo(req.Raw, addr); err != nil {
+		return nil, errors.Wrap(err, "failed to send request")
+	}
+	select {
+	case res := <-ch:
+		return res, nil
+	case <-time.After(defaultRTTimeout):
+		return nil, errors.New("timed out waiting for response")
+	}
+}
+
+// build constructs a request of the given type, attaching credentials
+// when nonce is non-empty.
+func (c *Client) build(t stun.MessageType, nonce stun.Nonce, realm stun.Realm, attrs ...stun.Setter) (*stun.Message, error) {
+	m := new(stun.Message)
+	setters := append([]stun.Setter{stun.TransactionID, t}, attrs...)
+	if len(c.software) > 0 {
+		setters = append(setters, c.software)
+	}
+	var integrity stun.MessageIntegrity
+	if len(nonce) > 0 {
+		setters = append(setters, &nonce, &c.username, &realm)
+		integrity = stun.NewLongTermIntegrity(string(c.username), string(realm), c.password)
+	}
+	if err := m.Build(setters...); err != nil {
+		return nil, errors.Wrap(err, "failed to build request")
+	}
+	if len(integrity) > 0 {
+		if err := integrity.AddTo(m); err != nil {
+			return nil, errors.Wrap(err, "failed to add integrity")
+		}
+	}
+	if err := stun.Fingerprint.AddTo(m); err != nil {
+		return nil, errors.Wrap(err, "failed to add fingerprint")
+	}
+	return m, nil
+}
+
+// authenticatedMessage builds a request or indication carrying the
+// client's currently cached nonce and realm, without performing a
+// round trip. It is used for indications, which never receive a
+// response to retry a stale-nonce challenge against.
+func (c *Client) authenticatedMessage(t stun.MessageType, attrs ...stun.Setter) (*stun.Message, error) {
+	c.mux.Lock()
+	nonce, realm := c.nonce, c.realm
+	c.mux.Unlock()
+	return c.build(t, nonce, realm, attrs...)
+}
+
+// doAuth performs a request/response round trip against the TURN
+// server, transparently retrying once with credentials if challenged
+// with 401 (Unauthorised) or 438 (Stale Nonce), per RFC 5766 Section 4.
+func (c *Client) doAuth(t stun.MessageType, attrs ...stun.Setter) (*stun.Message, error) {
+	c.mux.Lock()
+	nonce, realm := c.nonce, c.realm
+	c.mux.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := c.build(t, nonce, realm, attrs...)
+		if err != nil {
+			return nil, err
+		}
+		res, err := c.roundTrip(req, c.turnAddr)
+		if err != nil {
+			return nil, err
+		}
+		var code stun.ErrorCodeAttribute
+		if err := code.GetFrom(res); err != nil {
+			return res, nil
+		}
+		if attempt == 0 && (code.Code == stun.CodeUnauthorised || code.Code == stun.CodeStaleNonce) {
+			var n stun.Nonce
+			if err := n.GetFrom(res); err != nil {
+				return nil, errors.Wrap(err, "challenge response missing nonce")
+			}
+			nonce = n
+			var r stun.Realm
+			if err := r.GetFrom(res); err == nil {
+				realm = r
+			}
+			c.mux.Lock()
+			c.nonce, c.realm = nonce, realm
+			c.mux.Unlock()
+			continue
+		}
+		return nil, errors.Errorf("turn: request failed with code %d", code.Code)
+	}
+	return nil, errors.New("turn: exhausted retries answering challenge")
+}
+
+// SendBindingRequest sends a STUN Binding request to the STUN server
+// and returns the client's reflexive (server-observed) address.
+func (c *Client) SendBindingRequest() (net.Addr, error) {
+	req, err := c.build(stun.BindingRequest, nil, stun.Realm{})
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.roundTrip(req, c.stunAddr)
+	if err != nil {
+		return nil, err
+	}
+	var addr stun.XORMappedAddress
+	if err := addr.GetFrom(res); err != nil {
+		return nil, errors.Wrap(err, "failed to get mapped address")
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+}
+
+// Allocate requests a relayed transport address from the TURN server,
+// per RFC 5766 Section 6. Only one allocation may be active at a time.
+func (c *Client) Allocate() (*Allocation, error) {
+	res, err := c.doAuth(turn.AllocateRequest, turn.RequestedTransport{Protocol: turn.ProtoUDP})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to allocate")
+	}
+	var relayed turn.RelayedAddress
+	if err := relayed.GetFrom(res); err != nil {
+		return nil, errors.Wrap(err, "failed to get relayed address")
+	}
+	var lifetime turn.Lifetime
+	switch err := lifetime.GetFrom(res); err {
+	case nil:
+	case stun.ErrAttributeNotFound:
+		lifetime.Duration = defaultAllocationLifetime
+	default:
+		return nil, errors.Wrap(err, "failed to get lifetime")
+	}
+	alloc := newAllocation(c, &net.UDPAddr{IP: relayed.IP, Port: relayed.Port}, lifetime.Duration)
+	c.allocMux.Lock()
+	c.alloc = alloc
+	c.allocMux.Unlock()
+	go alloc.keepAlive()
+	return alloc, nil
+}
+
+// Close releases the client's local socket and stops its active
+// allocation's background refresh, if any.
+func (c *Client) Close() error {
+	c.allocMux.Lock()
+	alloc := c.alloc
+	c.alloc = nil
+	c.allocMux.Unlock()
+	if alloc != nil {
+		alloc.stop()
+	}
+	return c.conn.Close()
+}
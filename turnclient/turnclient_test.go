@@ -0,0 +1,125 @@
+package turnclient
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/gortc/gortcd/internal/server"
+	"github.com/gortc/stun"
+)
+
+// staticAuth is a minimal server.Auth implementation for this test; the
+// repo's own long-term credential store is out of scope here.
+type staticAuth struct {
+	username, realm, password string
+}
+
+func (a staticAuth) Auth(m *stun.Message) (stun.MessageIntegrity, error) {
+	i := stun.NewLongTermIntegrity(a.username, a.realm, a.password)
+	if err := i.Check(m); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// TestClient_Integration boots a server.Server, allocates a relayed
+// address through a Client, and verifies a UDP round trip through the
+// relay to a loopback echo peer.
+func TestClient_Integration(t *testing.T) {
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close() // nolint:errcheck
+
+	s, err := server.New(server.Options{
+		Log:   zap.NewNop(),
+		Auth:  staticAuth{username: "user", realm: "realm", password: "pass"},
+		Realm: "realm",
+
+		UDPConn: udpConn,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve() // nolint:errcheck
+
+	echoConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoConn.Close() // nolint:errcheck
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := echoConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if _, err := echoConn.WriteTo(buf[:n], addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	c, err := New(Config{
+		STUNServerAddr: udpConn.LocalAddr().String(),
+		TURNServerAddr: udpConn.LocalAddr().String(),
+		Username:       "user",
+		Password:       "pass",
+		Realm:          "realm",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close() // nolint:errcheck
+	if err := c.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.SendBindingRequest(); err != nil {
+		t.Fatal(err)
+	}
+
+	alloc, err := c.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alloc.Close() // nolint:errcheck
+
+	if err := alloc.CreatePermission(echoConn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte("hello turn")
+	if _, err := alloc.WriteTo(want, echoConn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		n    int
+		addr net.Addr
+		err  error
+	}
+	done := make(chan result, 1)
+	buf := make([]byte, 1500)
+	go func() {
+		n, addr, err := alloc.ReadFrom(buf)
+		done <- result{n: n, addr: addr, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		if got := string(buf[:r.n]); got != string(want) {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for echoed data through the relay")
+	}
+}